@@ -0,0 +1,136 @@
+package v1alpha1
+
+// ApplicationSourceKustomize holds options specific to an Application source
+// that uses Kustomize.
+type ApplicationSourceKustomize struct {
+	// NamePrefix is a prefix appended to resources for Kustomize apps
+	NamePrefix string `json:"namePrefix,omitempty" protobuf:"bytes,1,opt,name=namePrefix"`
+	// NameSuffix is a suffix appended to resources for Kustomize apps
+	NameSuffix string `json:"nameSuffix,omitempty" protobuf:"bytes,2,opt,name=nameSuffix"`
+	// Images is a list of Kustomize image override specifications
+	Images KustomizeImages `json:"images,omitempty" protobuf:"bytes,3,rep,name=images"`
+	// CommonLabels is a list of additional labels to add to rendered manifests
+	CommonLabels map[string]string `json:"commonLabels,omitempty" protobuf:"bytes,4,opt,name=commonLabels"`
+	// ConfigMapGenerators is a list of Kustomize ConfigMap generator specifications
+	ConfigMapGenerators KustomizeConfigMapGenerators `json:"configMapGenerators,omitempty" protobuf:"bytes,5,rep,name=configMapGenerators"`
+	// Namespace sets the namespace that kustomize adds to all resources
+	Namespace string `json:"namespace,omitempty" protobuf:"bytes,8,opt,name=namespace"`
+	// Replicas overrides the replica count of named resources
+	Replicas []KustomizeReplica `json:"replicas,omitempty" protobuf:"bytes,9,rep,name=replicas"`
+	// PatchesStrategicMerge is a list of inline strategic merge patches to apply
+	PatchesStrategicMerge []string `json:"patchesStrategicMerge,omitempty" protobuf:"bytes,10,rep,name=patchesStrategicMerge"`
+	// PatchesJson6902 is a list of inline JSON 6902 patches, each targeting a specific resource
+	PatchesJson6902 []KustomizeJson6902Patch `json:"patchesJson6902,omitempty" protobuf:"bytes,11,rep,name=patchesJson6902"`
+	// PluginConfig enables running `kustomize build` with alpha KRM function / containerized
+	// plugin support, under a sandboxed set of allowed images and bind mounts
+	PluginConfig *KustomizePluginConfig `json:"pluginConfig,omitempty" protobuf:"bytes,12,opt,name=pluginConfig"`
+	// Version pins the kustomize binary version used to build this application, resolved through
+	// the argocd-cm ConfigMap's `kustomize.path.<version>` entries. An explicit binary path given
+	// when the kustomize runner is created takes precedence over Version. If Version is unset, or no
+	// matching entry is configured, that explicit path is used, or else the kustomize binary on PATH.
+	Version string `json:"version,omitempty" protobuf:"bytes,13,opt,name=version"`
+	// HelmCharts is a list of kustomize `helmCharts` entries to inflate and merge into the build
+	HelmCharts []KustomizeHelmChart `json:"helmCharts,omitempty" protobuf:"bytes,14,rep,name=helmCharts"`
+	// Substitute is a map of literal values to shell-style expand (`${var}`) into the rendered
+	// manifests after `kustomize build` has produced them
+	Substitute map[string]string `json:"substitute,omitempty" protobuf:"bytes,6,opt,name=substitute"`
+	// SubstituteFrom references in-cluster ConfigMaps/Secrets whose data is merged into the
+	// substitution variables available to Substitute, in order, before Substitute's own overrides
+	SubstituteFrom []SubstituteReference `json:"substituteFrom,omitempty" protobuf:"bytes,7,rep,name=substituteFrom"`
+}
+
+// SubstituteReference points at an in-cluster ConfigMap or Secret whose data should be made
+// available as post-build substitution variables.
+type SubstituteReference struct {
+	// Name is the name of the referenced ConfigMap or Secret
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Kind is either "ConfigMap" or "Secret"
+	Kind string `json:"kind" protobuf:"bytes,2,opt,name=kind"`
+	// Optional, when true, causes a missing ConfigMap/Secret to be silently skipped rather than
+	// failing the substitution phase
+	Optional bool `json:"optional,omitempty" protobuf:"varint,3,opt,name=optional"`
+}
+
+// KustomizeImages is a list of Kustomize image override specifications
+type KustomizeImages []string
+
+// KustomizeConfigMapGenerators is a list of Kustomize ConfigMap generator specifications
+type KustomizeConfigMapGenerators []KustomizeConfigMapGenerator
+
+// KustomizeReplica overrides the replica count of the named resource
+type KustomizeReplica struct {
+	// Name is the name of the resource to apply the replica count to
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Count is the desired replica count
+	Count int `json:"count" protobuf:"varint,2,opt,name=count"`
+}
+
+// KustomizeJson6902Patch describes a single `patchesJson6902` entry targeting one resource
+type KustomizeJson6902Patch struct {
+	// Target identifies the resource the patch applies to
+	Target KustomizeJson6902Target `json:"target" protobuf:"bytes,1,opt,name=target"`
+	// Patch is the inline JSON 6902 patch document
+	Patch string `json:"patch" protobuf:"bytes,2,opt,name=patch"`
+}
+
+// KustomizeJson6902Target identifies the resource a KustomizeJson6902Patch applies to
+type KustomizeJson6902Target struct {
+	Group     string `json:"group,omitempty" protobuf:"bytes,1,opt,name=group"`
+	Version   string `json:"version,omitempty" protobuf:"bytes,2,opt,name=version"`
+	Kind      string `json:"kind,omitempty" protobuf:"bytes,3,opt,name=kind"`
+	Name      string `json:"name,omitempty" protobuf:"bytes,4,opt,name=name"`
+	Namespace string `json:"namespace,omitempty" protobuf:"bytes,5,opt,name=namespace"`
+}
+
+// KustomizePluginConfig constrains execution of KRM function / containerized kustomize plugins.
+type KustomizePluginConfig struct {
+	// AllowedImages is the set of container images KRM functions declared in this application's
+	// kustomization tree are permitted to run. An entry without a tag permits any tag of that
+	// image. An empty list permits no containerized functions to run.
+	AllowedImages []string `json:"allowedImages,omitempty" protobuf:"bytes,1,rep,name=allowedImages"`
+	// Network, when true, allows KRM function containers network access
+	Network bool `json:"network,omitempty" protobuf:"varint,2,opt,name=network"`
+	// Mounts is the set of bind mounts KRM function containers are permitted to use
+	Mounts []StorageMount `json:"mounts,omitempty" protobuf:"bytes,3,rep,name=mounts"`
+}
+
+// StorageMount describes a single bind mount offered to a containerized KRM function.
+type StorageMount struct {
+	// Type is the mount type, e.g. "bind"
+	Type string `json:"type" protobuf:"bytes,1,opt,name=type"`
+	// Src is the host path to mount, relative to the application working directory unless it
+	// begins with "~" (expanded to the repo-server's home directory) or is absolute
+	Src string `json:"src" protobuf:"bytes,2,opt,name=src"`
+	// Dst is the in-container path the mount is made available at
+	Dst string `json:"dst" protobuf:"bytes,3,opt,name=dst"`
+	// ReadOnly, when true, mounts Src read-only
+	ReadOnly bool `json:"readOnly,omitempty" protobuf:"varint,4,opt,name=readOnly"`
+}
+
+// KustomizeHelmChart describes a single kustomize `helmCharts` entry to inflate during the build.
+type KustomizeHelmChart struct {
+	// Name is the chart name
+	Name string `json:"name" protobuf:"bytes,1,opt,name=name"`
+	// Repo is the chart repository URL
+	Repo string `json:"repo" protobuf:"bytes,2,opt,name=repo"`
+	// Version is the chart version to pull
+	Version string `json:"version,omitempty" protobuf:"bytes,3,opt,name=version"`
+	// ReleaseName overrides the release name used when rendering the chart
+	ReleaseName string `json:"releaseName,omitempty" protobuf:"bytes,4,opt,name=releaseName"`
+	// ValuesFile is a values file, relative to the application source, to inflate the chart with
+	ValuesFile string `json:"valuesFile,omitempty" protobuf:"bytes,5,opt,name=valuesFile"`
+	// ValuesInline is inline YAML merged over ValuesFile (or used standalone if ValuesFile is unset)
+	ValuesInline string `json:"valuesInline,omitempty" protobuf:"bytes,6,opt,name=valuesInline"`
+}
+
+// KustomizeConfigMapGenerator describes a single `configMapGenerator` entry
+type KustomizeConfigMapGenerator struct {
+	// Name is the base name of the generated ConfigMap
+	Name string `json:"name,omitempty" protobuf:"bytes,1,opt,name=name"`
+	// Literals are literal `key=value` pairs to add to the generated ConfigMap
+	Literals []string `json:"literals,omitempty" protobuf:"bytes,2,rep,name=literals"`
+	// Files are `key=path` (or bare `path`) file references to add to the generated ConfigMap
+	Files []string `json:"files,omitempty" protobuf:"bytes,3,rep,name=files"`
+	// EnvFiles are env-file references to add to the generated ConfigMap
+	EnvFiles []string `json:"envs,omitempty" protobuf:"bytes,4,rep,name=envs"`
+}
@@ -0,0 +1,201 @@
+package kustomize
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// buildFlagSpec describes one recognized `kustomize build` flag.
+type buildFlagSpec struct {
+	name       string
+	takesValue bool
+}
+
+var knownBuildFlags = []buildFlagSpec{
+	{name: "--enable-alpha-plugins", takesValue: false},
+	{name: "--load-restrictor", takesValue: true},
+	{name: "--reorder", takesValue: true},
+	{name: "--enable-helm", takesValue: false},
+	{name: "--helm-command", takesValue: true},
+}
+
+func lookupBuildFlagSpec(name string) (buildFlagSpec, bool) {
+	for _, spec := range knownBuildFlags {
+		if spec.name == name {
+			return spec, true
+		}
+	}
+	return buildFlagSpec{}, false
+}
+
+// BuildOptions is a structured, validated view of the operator-supplied kustomize build flags.
+type BuildOptions struct {
+	EnableAlphaPlugins bool
+	LoadRestrictor     string
+	Reorder            string
+	EnableHelm         bool
+	HelmCommand        string
+}
+
+// ParseBuildOptions parses a raw, space-separated build options string (as configured on an
+// Application or the argocd-cm ConfigMap) into a BuildOptions, rejecting anything that isn't one
+// of the flags kustomize build actually accepts for tenant use.
+func ParseBuildOptions(raw string) (BuildOptions, error) {
+	var opts BuildOptions
+	fields := strings.Fields(raw)
+
+	for i := 0; i < len(fields); i++ {
+		token := fields[i]
+		name := token
+		value := ""
+		hasInline := false
+		if eq := strings.Index(token, "="); eq != -1 {
+			name = token[:eq]
+			value = token[eq+1:]
+			hasInline = true
+		}
+
+		spec, ok := lookupBuildFlagSpec(name)
+		if !ok {
+			return BuildOptions{}, fmt.Errorf("unknown kustomize build option %q", name)
+		}
+
+		if spec.takesValue {
+			if !hasInline {
+				if i+1 >= len(fields) {
+					return BuildOptions{}, fmt.Errorf("kustomize build option %q requires a value", name)
+				}
+				i++
+				value = fields[i]
+			}
+			if value == "" {
+				return BuildOptions{}, fmt.Errorf("kustomize build option %q requires a value", name)
+			}
+		} else if hasInline {
+			return BuildOptions{}, fmt.Errorf("kustomize build option %q does not take a value", name)
+		}
+
+		switch name {
+		case "--enable-alpha-plugins":
+			opts.EnableAlphaPlugins = true
+		case "--load-restrictor":
+			opts.LoadRestrictor = value
+		case "--reorder":
+			opts.Reorder = value
+		case "--enable-helm":
+			opts.EnableHelm = true
+		case "--helm-command":
+			opts.HelmCommand = value
+		}
+	}
+
+	return opts, nil
+}
+
+// Args renders opts back into the `kustomize build` argument form.
+func (o BuildOptions) Args() []string {
+	var args []string
+	if o.EnableAlphaPlugins {
+		args = append(args, "--enable-alpha-plugins")
+	}
+	if o.LoadRestrictor != "" {
+		args = append(args, "--load-restrictor", o.LoadRestrictor)
+	}
+	if o.Reorder != "" {
+		args = append(args, "--reorder", o.Reorder)
+	}
+	if o.EnableHelm {
+		args = append(args, "--enable-helm")
+	}
+	if o.HelmCommand != "" {
+		args = append(args, "--helm-command", o.HelmCommand)
+	}
+	return args
+}
+
+// Validate checks opts against an admin-configured BuildOptionsPolicy, returning a clear error for
+// the first setting the policy doesn't permit.
+func (o BuildOptions) Validate(policy BuildOptionsPolicy) error {
+	if o.EnableAlphaPlugins && !policy.AllowEnableAlphaPlugins {
+		return fmt.Errorf("kustomize build option --enable-alpha-plugins is not permitted by platform policy")
+	}
+	if o.LoadRestrictor != "" && !policy.allowsLoadRestrictor(o.LoadRestrictor) {
+		return fmt.Errorf("kustomize build option --load-restrictor=%s is not permitted by platform policy", o.LoadRestrictor)
+	}
+	if o.EnableHelm && !policy.AllowEnableHelm {
+		return fmt.Errorf("kustomize build option --enable-helm is not permitted by platform policy")
+	}
+	if o.HelmCommand != "" && !policy.allowsHelmCommand(o.HelmCommand) {
+		return fmt.Errorf("kustomize build option --helm-command=%s is not permitted by platform policy", o.HelmCommand)
+	}
+	return nil
+}
+
+// BuildOptionsPolicy is the admin-configurable allow list tenants' build options are checked
+// against. The zero value is the most restrictive policy: no alpha plugins, no helm, and only the
+// default (root-only) load restrictor.
+type BuildOptionsPolicy struct {
+	AllowEnableAlphaPlugins bool
+	AllowedLoadRestrictors  []string
+	AllowEnableHelm         bool
+	AllowedHelmCommands     []string
+}
+
+// DefaultBuildOptionsPolicy is the restrictive policy applied until an admin configures otherwise.
+func DefaultBuildOptionsPolicy() BuildOptionsPolicy {
+	return BuildOptionsPolicy{
+		AllowedLoadRestrictors: []string{"LoadRestrictionsRootOnly"},
+	}
+}
+
+func (p BuildOptionsPolicy) allowsLoadRestrictor(value string) bool {
+	for _, allowed := range p.AllowedLoadRestrictors {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (p BuildOptionsPolicy) allowsHelmCommand(value string) bool {
+	for _, allowed := range p.AllowedHelmCommands {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	globalBuildOptionsPolicyMu sync.RWMutex
+	globalBuildOptionsPolicy   = DefaultBuildOptionsPolicy()
+)
+
+// SetBuildOptionsPolicy installs the process-wide build options policy, refreshed by the repo
+// server whenever the argocd-cm ConfigMap changes.
+func SetBuildOptionsPolicy(policy BuildOptionsPolicy) {
+	globalBuildOptionsPolicyMu.Lock()
+	defer globalBuildOptionsPolicyMu.Unlock()
+	globalBuildOptionsPolicy = policy
+}
+
+// CurrentBuildOptionsPolicy returns the process-wide policy installed by SetBuildOptionsPolicy.
+func CurrentBuildOptionsPolicy() BuildOptionsPolicy {
+	globalBuildOptionsPolicyMu.RLock()
+	defer globalBuildOptionsPolicyMu.RUnlock()
+	return globalBuildOptionsPolicy
+}
+
+// parseKustomizeBuildOptions parses and validates an operator-supplied build options string
+// against the current BuildOptionsPolicy, returning the full `kustomize build` argument list.
+func parseKustomizeBuildOptions(path, buildOptions string) ([]string, error) {
+	opts, err := ParseBuildOptions(buildOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Validate(CurrentBuildOptionsPolicy()); err != nil {
+		return nil, err
+	}
+	return append([]string{"build", path}, opts.Args()...), nil
+}
@@ -0,0 +1,189 @@
+package kustomize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/argoproj/pkg/exec"
+	"github.com/ghodss/yaml"
+
+	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+)
+
+var (
+	globalHelmBinaryPathMu sync.RWMutex
+	globalHelmBinaryPath   = "helm"
+)
+
+// SetHelmBinaryPath configures the helm executable used to pull charts declared under
+// ApplicationSourceKustomize.HelmCharts and passed to `kustomize build --helm-command`.
+func SetHelmBinaryPath(path string) {
+	globalHelmBinaryPathMu.Lock()
+	defer globalHelmBinaryPathMu.Unlock()
+	globalHelmBinaryPath = path
+}
+
+// CurrentHelmBinaryPath returns the helm executable installed by SetHelmBinaryPath.
+func CurrentHelmBinaryPath() string {
+	globalHelmBinaryPathMu.RLock()
+	defer globalHelmBinaryPathMu.RUnlock()
+	return globalHelmBinaryPath
+}
+
+// pullHelmCharts pre-populates a chart-home directory with `helm pull --untar` for every declared
+// chart, so that `kustomize build --enable-helm` can inflate them without reaching out to the
+// chart repositories itself (required for offline/air-gapped repo servers). The returned cleanup
+// func removes the chart-home directory; callers should defer it regardless of the returned error.
+func pullHelmCharts(charts []v1alpha1.KustomizeHelmChart) (string, func(), error) {
+	if len(charts) == 0 {
+		return "", func() {}, nil
+	}
+
+	chartHome, err := ioutil.TempDir("", "kustomize-helm-charts")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() { _ = os.RemoveAll(chartHome) }
+
+	for _, chart := range charts {
+		args := []string{"pull", "--repo", chart.Repo, "--untar", "--untardir", chartHome}
+		if chart.Version != "" {
+			args = append(args, "--version", chart.Version)
+		}
+		// "--" stops chart.Name (attacker/operator controlled) from being parsed as a flag.
+		args = append(args, "--", chart.Name)
+		if _, err := exec.RunCommand(CurrentHelmBinaryPath(), exec.CmdOpts{}, args...); err != nil {
+			return chartHome, cleanup, fmt.Errorf("failed to pull helm chart %q: %w", chart.Name, err)
+		}
+	}
+
+	return chartHome, cleanup, nil
+}
+
+// mergeHelmValues merges chart.ValuesInline over chart.ValuesFile (read relative to appPath, if
+// set) and, if either was provided, writes the merged result to a temp file under appPath,
+// returning its path relative to appPath for injection into the kustomization.
+func mergeHelmValues(appPath string, chart v1alpha1.KustomizeHelmChart) (string, error) {
+	if chart.ValuesFile == "" && chart.ValuesInline == "" {
+		return "", nil
+	}
+
+	merged := map[string]interface{}{}
+	if chart.ValuesFile != "" {
+		valuesFilePath := filepath.Clean(filepath.Join(appPath, chart.ValuesFile))
+		if !pathUnder(valuesFilePath, appPath) {
+			return "", fmt.Errorf("valuesFile %q for chart %q resolves outside the application working directory", chart.ValuesFile, chart.Name)
+		}
+		data, err := ioutil.ReadFile(valuesFilePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read valuesFile for chart %q: %w", chart.Name, err)
+		}
+		if err := yaml.Unmarshal(data, &merged); err != nil {
+			return "", fmt.Errorf("failed to parse valuesFile for chart %q: %w", chart.Name, err)
+		}
+	}
+	if chart.ValuesInline != "" {
+		var inline map[string]interface{}
+		if err := yaml.Unmarshal([]byte(chart.ValuesInline), &inline); err != nil {
+			return "", fmt.Errorf("failed to parse valuesInline for chart %q: %w", chart.Name, err)
+		}
+		mergeValuesMaps(merged, inline)
+	}
+
+	out, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := fmt.Sprintf(".argocd-helm-values-%s.yaml", sanitizeChartNameForFile(chart.Name))
+	if err := ioutil.WriteFile(filepath.Join(appPath, fileName), out, 0644); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// unsafeFileNameChars matches anything but [A-Za-z0-9_.-], so a chart name can't smuggle a path
+// separator or ".." segment into the generated values file name.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func sanitizeChartNameForFile(name string) string {
+	return unsafeFileNameChars.ReplaceAllString(name, "_")
+}
+
+// mergeValuesMaps deep-merges src into dst, with src's values taking precedence.
+func mergeValuesMaps(dst, src map[string]interface{}) {
+	for key, srcVal := range src {
+		if dstVal, ok := dst[key]; ok {
+			dstMap, dstIsMap := dstVal.(map[string]interface{})
+			srcMap, srcIsMap := srcVal.(map[string]interface{})
+			if dstIsMap && srcIsMap {
+				mergeValuesMaps(dstMap, srcMap)
+				continue
+			}
+		}
+		dst[key] = srcVal
+	}
+}
+
+// addHelmCharts injects a `helmCharts`/`helmGlobals` section into the kustomization file for each
+// declared chart, pointing at the pre-pulled chartHome and a merged values file where applicable.
+func (k *kustomize) addHelmCharts(charts []v1alpha1.KustomizeHelmChart, chartHome string) error {
+	if len(charts) == 0 {
+		return nil
+	}
+
+	kustomizationFile, err := k.findKustomization()
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(kustomizationFile)
+	if err != nil {
+		return err
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+
+	helmGlobals, _ := doc["helmGlobals"].(map[string]interface{})
+	if helmGlobals == nil {
+		helmGlobals = map[string]interface{}{}
+	}
+	helmGlobals["chartHome"] = chartHome
+	doc["helmGlobals"] = helmGlobals
+
+	existingEntries, _ := doc["helmCharts"].([]interface{})
+	entries := make([]interface{}, 0, len(existingEntries)+len(charts))
+	entries = append(entries, existingEntries...)
+	for _, chart := range charts {
+		entry := map[string]interface{}{
+			"name": chart.Name,
+			"repo": chart.Repo,
+		}
+		if chart.Version != "" {
+			entry["version"] = chart.Version
+		}
+		if chart.ReleaseName != "" {
+			entry["releaseName"] = chart.ReleaseName
+		}
+		valuesFile, err := mergeHelmValues(k.path, chart)
+		if err != nil {
+			return err
+		}
+		if valuesFile != "" {
+			entry["valuesFile"] = valuesFile
+		}
+		entries = append(entries, entry)
+	}
+	doc["helmCharts"] = entries
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(kustomizationFile, out, 0644)
+}
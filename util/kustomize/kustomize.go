@@ -0,0 +1,366 @@
+package kustomize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/argoproj/pkg/exec"
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/argo-cd/util/git"
+)
+
+// KustomizationYaml, KustomizationYml and KustomizationName are the three
+// file names kustomize recognizes as the kustomization root.
+const (
+	KustomizationYaml = "kustomization.yaml"
+	KustomizationYml  = "kustomization.yml"
+	KustomizationName = "Kustomization"
+)
+
+// Kustomize is an interface to run a `kustomize build` command against an
+// application's source directory, applying any Argo CD supplied overrides.
+type Kustomize interface {
+	// Build returns a list of unstructured objects from a `kustomize build` command and a list of
+	// images contained in that path
+	Build(kustomizeSource *v1alpha1.ApplicationSourceKustomize, buildOpts []string) ([]*unstructured.Unstructured, []string, error)
+}
+
+// NewKustomizeApp create a new wrapper to run commands on the `kustomize` command-line tool.
+func NewKustomizeApp(path string, creds git.Creds, fromRepo string, binaryPath string) Kustomize {
+	return &kustomize{
+		path:       path,
+		creds:      creds,
+		repo:       fromRepo,
+		binaryPath: binaryPath,
+	}
+}
+
+type kustomize struct {
+	// path to the Kustomize application directory
+	path string
+	// creds are credentials used to acquire repository-hosted values (e.g. remote bases)
+	creds git.Creds
+	// repo is the URL of the repository this application was rendered from
+	repo string
+	// binaryPath is the path to a non-default `kustomize` binary, if any
+	binaryPath string
+	// resolvedBinary is the binary this Build invocation ultimately dispatches to, pinned once at
+	// the start of Build so that every subsequent `kustomize edit`/`kustomize build` call in the
+	// same invocation agrees on the same version.
+	resolvedBinary string
+}
+
+var _ Kustomize = &kustomize{}
+
+func (k *kustomize) binary() string {
+	if k.resolvedBinary != "" {
+		return k.resolvedBinary
+	}
+	if k.binaryPath != "" {
+		return k.binaryPath
+	}
+	return "kustomize"
+}
+
+// resolveBinary pins the kustomize binary to use for this Build invocation: an explicit
+// binaryPath set at construction always wins, otherwise the requested Version is looked up in the
+// process-wide BinaryPathRegistry, falling back to the default "kustomize" on PATH. It always
+// recomputes resolvedBinary from scratch so that a *kustomize reused across multiple Build calls
+// (e.g. with different kustomizeSource.Version values, or Version cleared) never keeps a stale
+// resolution from a previous call.
+func (k *kustomize) resolveBinary(kustomizeSource *v1alpha1.ApplicationSourceKustomize) {
+	k.resolvedBinary = ""
+	if k.binaryPath != "" || kustomizeSource == nil || kustomizeSource.Version == "" {
+		return
+	}
+	if path, ok := CurrentBinaryPathRegistry().Lookup(kustomizeSource.Version); ok {
+		k.resolvedBinary = path
+	}
+}
+
+func (k *kustomize) Build(kustomizeSource *v1alpha1.ApplicationSourceKustomize, buildOpts []string) ([]*unstructured.Unstructured, []string, error) {
+	k.resolveBinary(kustomizeSource)
+	if kustomizeSource != nil {
+		if kustomizeSource.NamePrefix != "" {
+			if _, err := k.run("edit", "set", "nameprefix", "--", kustomizeSource.NamePrefix); err != nil {
+				return nil, nil, err
+			}
+		}
+		if kustomizeSource.NameSuffix != "" {
+			if _, err := k.run("edit", "set", "namesuffix", "--", kustomizeSource.NameSuffix); err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(kustomizeSource.Images) > 0 {
+			args := []string{"edit", "set", "image"}
+			for _, image := range kustomizeSource.Images {
+				args = append(args, string(image))
+			}
+			if _, err := k.run(args...); err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(kustomizeSource.CommonLabels) > 0 {
+			args := []string{"edit", "add", "label"}
+			pairs := make([]string, 0, len(kustomizeSource.CommonLabels))
+			for label, value := range kustomizeSource.CommonLabels {
+				pairs = append(pairs, fmt.Sprintf("%s:%s", label, value))
+			}
+			args = append(args, strings.Join(pairs, ","))
+			if _, err := k.run(args...); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := k.addConfigMapGenerators(kustomizeSource.ConfigMapGenerators); err != nil {
+			return nil, nil, err
+		}
+		if kustomizeSource.Namespace != "" {
+			if _, err := k.run("edit", "set", "namespace", "--", kustomizeSource.Namespace); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, replica := range kustomizeSource.Replicas {
+			spec := fmt.Sprintf("%s=%d", replica.Name, replica.Count)
+			if _, err := k.run("edit", "set", "replicas", spec); err != nil {
+				return nil, nil, err
+			}
+		}
+		cleanupPatches, err := k.addPatches(kustomizeSource.PatchesStrategicMerge, kustomizeSource.PatchesJson6902)
+		defer cleanupPatches()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(kustomizeSource.HelmCharts) > 0 {
+			chartHome, cleanupCharts, err := pullHelmCharts(kustomizeSource.HelmCharts)
+			defer cleanupCharts()
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := k.addHelmCharts(kustomizeSource.HelmCharts, chartHome); err != nil {
+				return nil, nil, err
+			}
+			buildOpts = append(buildOpts, "--enable-helm", "--helm-command", CurrentHelmBinaryPath())
+		}
+	}
+
+	if kustomizeSource != nil && kustomizeSource.PluginConfig != nil {
+		if err := k.enforcePluginImageAllowlist(kustomizeSource.PluginConfig); err != nil {
+			return nil, nil, err
+		}
+		mounts, err := resolvePluginMounts(k.path, repoManifestServerHome(), kustomizeSource.PluginConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Mounts/network are enforced by rewriting each function's own functionConfig annotation,
+		// which is what kustomize's containerized KRM function runtime actually reads them from --
+		// not by exporting them as env vars on the `kustomize build` subprocess itself.
+		if err := k.applyPluginSandbox(mounts, kustomizeSource.PluginConfig.Network); err != nil {
+			return nil, nil, err
+		}
+		buildOpts = append(buildOpts, "--enable-alpha-plugins")
+	}
+
+	// buildOpts at this point includes both the operator-supplied options and any flags injected
+	// above for HelmCharts/PluginConfig, so validating here is what actually gates those features
+	// behind the platform policy rather than just the flags an operator typed in directly.
+	parsedOpts, err := ParseBuildOptions(strings.Join(buildOpts, " "))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := parsedOpts.Validate(CurrentBuildOptionsPolicy()); err != nil {
+		return nil, nil, err
+	}
+
+	cmd := append([]string{"build", k.path}, buildOpts...)
+	out, err := k.run(cmd...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objs, err := unmarshalManifests(out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ConfigMap/Secret backed SubstituteFrom values must be fetched by the caller and applied via
+	// ExpandSubstitutions; literal Substitute values don't need a cluster round-trip, so we can
+	// apply them here as part of the build itself.
+	if kustomizeSource != nil && len(kustomizeSource.SubstituteFrom) == 0 {
+		if err := ExpandSubstitutions(objs, kustomizeSource, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	images := discoverImages(objs)
+
+	return objs, images, nil
+}
+
+func (k *kustomize) addConfigMapGenerators(generators v1alpha1.KustomizeConfigMapGenerators) error {
+	for _, gen := range generators {
+		args := []string{"edit", "add", "configmap", gen.Name}
+		if len(gen.Literals) > 0 {
+			args = append(args, "--from-literal", strings.Join(gen.Literals, ","))
+		}
+		for _, f := range gen.Files {
+			args = append(args, "--from-file", f)
+		}
+		for _, e := range gen.EnvFiles {
+			args = append(args, "--from-env-file", e)
+		}
+		if _, err := k.run(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPatches writes each strategic-merge and JSON 6902 patch to a temp file inside the
+// application working directory (kustomize only accepts patches as files, not inline content)
+// and registers them with `kustomize edit add patch`. The returned cleanup func removes the temp
+// files again; callers should defer it regardless of the returned error.
+func (k *kustomize) addPatches(strategicMerge []string, json6902 []v1alpha1.KustomizeJson6902Patch) (func(), error) {
+	var patchFiles []string
+	cleanup := func() {
+		for _, f := range patchFiles {
+			_ = os.Remove(f)
+		}
+	}
+
+	for i, patch := range strategicMerge {
+		file := filepath.Join(k.path, fmt.Sprintf(".argocd-patch-sm-%d.yaml", i))
+		if err := ioutil.WriteFile(file, []byte(patch), 0644); err != nil {
+			return cleanup, err
+		}
+		patchFiles = append(patchFiles, file)
+		if _, err := k.run("edit", "add", "patch", "--path", filepath.Base(file)); err != nil {
+			return cleanup, err
+		}
+	}
+
+	for i, patch := range json6902 {
+		file := filepath.Join(k.path, fmt.Sprintf(".argocd-patch-json6902-%d.yaml", i))
+		if err := ioutil.WriteFile(file, []byte(patch.Patch), 0644); err != nil {
+			return cleanup, err
+		}
+		patchFiles = append(patchFiles, file)
+		args := []string{"edit", "add", "patch", "--path", filepath.Base(file)}
+		if patch.Target.Group != "" {
+			args = append(args, "--group", patch.Target.Group)
+		}
+		if patch.Target.Version != "" {
+			args = append(args, "--version", patch.Target.Version)
+		}
+		if patch.Target.Kind != "" {
+			args = append(args, "--kind", patch.Target.Kind)
+		}
+		if patch.Target.Name != "" {
+			args = append(args, "--name", patch.Target.Name)
+		}
+		if patch.Target.Namespace != "" {
+			args = append(args, "--namespace", patch.Target.Namespace)
+		}
+		if _, err := k.run(args...); err != nil {
+			return cleanup, err
+		}
+	}
+
+	return cleanup, nil
+}
+
+func (k *kustomize) run(args ...string) (string, error) {
+	return k.runWithEnv(nil, args...)
+}
+
+func (k *kustomize) runWithEnv(env []string, args ...string) (string, error) {
+	var cmdEnv []string
+	if len(env) > 0 {
+		// exec.CmdOpts.Env, once set, replaces the subprocess environment outright rather than
+		// augmenting it, so the extra vars must be layered on top of the inherited environment or
+		// the kustomize/helm/plugin subprocess loses PATH, HOME and any credential helpers it needs.
+		cmdEnv = append(os.Environ(), env...)
+	}
+	return exec.RunCommand(k.binary(), exec.CmdOpts{Dir: k.path, Env: cmdEnv}, args...)
+}
+
+func unmarshalManifests(out string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	for _, doc := range strings.Split(out, "---\n") {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		obj := make(map[string]interface{})
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, err
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		objs = append(objs, &unstructured.Unstructured{Object: obj})
+	}
+	return objs, nil
+}
+
+func discoverImages(objs []*unstructured.Unstructured) []string {
+	var images []string
+	seen := make(map[string]bool)
+	for _, obj := range objs {
+		containers, found, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		if !found {
+			continue
+		}
+		for _, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			image, ok := container["image"].(string)
+			if !ok || seen[image] {
+				continue
+			}
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// findKustomization looks for a kustomization file (in the 3 accepted spellings) in the application path.
+func (k *kustomize) findKustomization() (string, error) {
+	for _, candidate := range []string{KustomizationYaml, KustomizationYml, KustomizationName} {
+		kustomization := filepath.Join(k.path, candidate)
+		if _, err := os.Stat(kustomization); err == nil {
+			return kustomization, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find kustomization in %s", k.path)
+}
+
+// IsKustomization returns true if the given file name is a recognized kustomization file name.
+func IsKustomization(name string) bool {
+	switch name {
+	case KustomizationYaml, KustomizationYml, KustomizationName:
+		return true
+	}
+	return false
+}
+
+// Version returns the version of the kustomize executable on PATH.
+func Version(shortForm bool) (string, error) {
+	executable := "kustomize"
+	args := []string{"version"}
+	if shortForm {
+		args = append(args, "--short")
+	}
+	out, err := exec.RunCommand(executable, exec.CmdOpts{}, args...)
+	if err != nil {
+		return "", fmt.Errorf("could not get kustomize version: %s", err)
+	}
+	return strings.TrimSpace(out), nil
+}
@@ -1,16 +1,26 @@
 package kustomize
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/argoproj/pkg/exec"
+	"github.com/ghodss/yaml"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
@@ -220,8 +230,22 @@ func TestIsKustomization(t *testing.T) {
 }
 
 func TestParseKustomizeBuildOptions(t *testing.T) {
-	built := parseKustomizeBuildOptions("guestbook", "-v 6 --logtostderr")
-	assert.Equal(t, []string{"build", "guestbook", "-v", "6", "--logtostderr"}, built)
+	built, err := parseKustomizeBuildOptions("guestbook", "--reorder none")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build", "guestbook", "--reorder", "none"}, built)
+
+	_, err = parseKustomizeBuildOptions("guestbook", "-v 6 --logtostderr")
+	assert.Error(t, err)
+}
+
+func TestBuildOptionsValidateAgainstPolicy(t *testing.T) {
+	opts, err := ParseBuildOptions("--load-restrictor LoadRestrictionsNone")
+	assert.NoError(t, err)
+
+	assert.Error(t, opts.Validate(DefaultBuildOptionsPolicy()))
+
+	permissive := BuildOptionsPolicy{AllowedLoadRestrictors: []string{"LoadRestrictionsNone"}}
+	assert.NoError(t, opts.Validate(permissive))
 }
 
 func TestVersion(t *testing.T) {
@@ -229,3 +253,364 @@ func TestVersion(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEmpty(t, ver)
 }
+
+func TestExpandValue(t *testing.T) {
+	vars := map[string]string{"region": "us-west-2", "tag": "v1.2.3"}
+
+	out, err := expandValue("${region}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "us-west-2", out)
+
+	out, err = expandValue("${missing:=fallback}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback", out)
+
+	out, err = expandValue("${region:3:4}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "west", out)
+
+	out, err = expandValue("${tag/v1/v2}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2.2.3", out)
+
+	// A ":=" default whose value itself contains a "/" must still be parsed as a default, not
+	// misdetected as a "/from/to" replacement.
+	out, err = expandValue("${region:=us/east-1}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "us-west-2", out)
+
+	out, err = expandValue("${az:=us/east-1}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "us/east-1", out)
+
+	_, err = expandValue("${missing}", vars)
+	assert.Error(t, err)
+}
+
+func TestExpandSubstitutions(t *testing.T) {
+	source := &v1alpha1.ApplicationSourceKustomize{
+		SubstituteFrom: []v1alpha1.SubstituteReference{
+			{Name: "env-config", Kind: "ConfigMap"},
+		},
+		Substitute: map[string]string{"region": "us-east-1"},
+	}
+	fromValues := map[string]map[string]string{
+		"ConfigMap/env-config": {"region": "us-west-2", "cluster": "prod"},
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name": "app-config",
+		},
+		"data": map[string]interface{}{
+			"region":  "${region}",
+			"cluster": "${cluster}",
+		},
+	}}
+
+	err := ExpandSubstitutions([]*unstructured.Unstructured{obj}, source, fromValues)
+	assert.NoError(t, err)
+
+	data, _, _ := unstructured.NestedMap(obj.Object, "data")
+	assert.Equal(t, "us-east-1", data["region"])
+	assert.Equal(t, "prod", data["cluster"])
+}
+
+func TestKustomizeBuildNamespaceAndReplicas(t *testing.T) {
+	appPath, destroyDataDir := testDataDir(t, "./testdata/"+kustomization1)
+	defer destroyDataDir()
+	kustomize := NewKustomizeApp(appPath, git.NopCreds{}, "", "")
+	kustomizeSource := v1alpha1.ApplicationSourceKustomize{
+		Namespace: "my-namespace",
+		Replicas: []v1alpha1.KustomizeReplica{
+			{Name: "nginx-deployment", Count: 3},
+		},
+	}
+	objs, _, err := kustomize.Build(&kustomizeSource, nil)
+	assert.Nil(t, err)
+	for _, obj := range objs {
+		assert.Equal(t, "my-namespace", obj.GetNamespace())
+		if obj.GetKind() == "Deployment" {
+			replicas, found, err := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+			assert.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, int64(3), replicas)
+		}
+	}
+}
+
+func TestResolveMountSrc(t *testing.T) {
+	appPath := "/repo/app"
+	home := "/home/argocd"
+
+	resolved, err := resolveMountSrc(appPath, home, "config")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(appPath, "config"), resolved)
+
+	resolved, err = resolveMountSrc(appPath, home, "~/plugins")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, "plugins"), resolved)
+
+	_, err = resolveMountSrc(appPath, home, "../../etc/passwd")
+	assert.Error(t, err)
+
+	_, err = resolveMountSrc(appPath, home, "/etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestImageAllowed(t *testing.T) {
+	allowed := []string{"gcr.io/kpt-fn/set-labels", "gcr.io/kpt-fn/search-replace:v1.0.0"}
+	assert.True(t, imageAllowed("gcr.io/kpt-fn/set-labels:v0.2.0", allowed))
+	assert.True(t, imageAllowed("gcr.io/kpt-fn/search-replace:v1.0.0", allowed))
+	assert.False(t, imageAllowed("gcr.io/kpt-fn/search-replace:v2.0.0", allowed))
+	assert.False(t, imageAllowed("docker.io/untrusted/image:latest", allowed))
+}
+
+func TestEnforcePluginImageAllowlistCatchesDisguisedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kustomize-plugin-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("generators:\n- generator.yaml\n"), 0644))
+
+	// A flow-style mapping with a trailing comment defeats a line-oriented `^image:\s*(\S+)$`
+	// regex, but not a structural YAML parse.
+	generatorYAML := "apiVersion: v1\n" +
+		"kind: ConfigMap\n" +
+		"metadata:\n" +
+		"  name: disguised\n" +
+		"  annotations:\n" +
+		"    config.kubernetes.io/function: |\n" +
+		"      container: {image: evil/image:latest} # pinned\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "generator.yaml"), []byte(generatorYAML), 0644))
+
+	k := &kustomize{path: dir}
+	err = k.enforcePluginImageAllowlist(&v1alpha1.KustomizePluginConfig{AllowedImages: []string{"gcr.io/kpt-fn/set-labels"}})
+	assert.Error(t, err)
+}
+
+func TestApplyPluginSandboxInjectsMountsAndNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kustomize-plugin-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("transformers:\n- transformer.yaml\n"), 0644))
+
+	transformerYAML := "apiVersion: v1\n" +
+		"kind: ConfigMap\n" +
+		"metadata:\n" +
+		"  name: set-labels\n" +
+		"  annotations:\n" +
+		"    config.kubernetes.io/function: |\n" +
+		"      container:\n" +
+		"        image: gcr.io/kpt-fn/set-labels:v0.1.5\n" +
+		"        network: true\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "transformer.yaml"), []byte(transformerYAML), 0644))
+
+	k := &kustomize{path: dir}
+	mounts := []v1alpha1.StorageMount{{Type: "bind", Src: "/repo/app/config", Dst: "/tmp/config", ReadOnly: true}}
+	assert.NoError(t, k.applyPluginSandbox(mounts, false))
+
+	updated, err := ioutil.ReadFile(filepath.Join(dir, "transformer.yaml"))
+	assert.NoError(t, err)
+
+	var doc map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal(updated, &doc))
+	fnRaw := doc["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})["config.kubernetes.io/function"].(string)
+
+	var fnDoc map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal([]byte(fnRaw), &fnDoc))
+	container := fnDoc["container"].(map[string]interface{})
+	assert.Equal(t, false, container["network"])
+
+	mountList, ok := container["mounts"].([]interface{})
+	assert.True(t, ok)
+	assert.Len(t, mountList, 1)
+	m := mountList[0].(map[string]interface{})
+	assert.Equal(t, "/repo/app/config", m["src"])
+	assert.Equal(t, "/tmp/config", m["dst"])
+	assert.Equal(t, true, m["readonly"])
+}
+
+// packageFakeHelmChart tars and gzips a minimal but valid Helm chart, returning the packaged bytes.
+func packageFakeHelmChart(t *testing.T) []byte {
+	files := []struct {
+		name, content string
+	}{
+		{"mychart/Chart.yaml", "apiVersion: v2\nname: mychart\nversion: 0.1.0\n"},
+		{"mychart/values.yaml", "architecture: standalone\n"},
+		{"mychart/templates/configmap.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: mychart-config\ndata:\n  architecture: {{ .Values.architecture }}\n"},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}); err != nil {
+			t.Fatalf("failed to write chart tar header: %s", err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatalf("failed to write chart tar content: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close chart tar writer: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("failed to close chart gzip writer: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// newFakeHelmChartServer serves a single-chart Helm repository index and the packaged chart itself,
+// so tests can exercise `helm pull --repo` against something other than an unreachable real host.
+func newFakeHelmChartServer(t *testing.T) *httptest.Server {
+	chartBytes := packageFakeHelmChart(t)
+	digest := sha256.Sum256(chartBytes)
+
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mychart-0.1.0.tgz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		_, _ = w.Write(chartBytes)
+	})
+	mux.HandleFunc("/index.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/yaml")
+		_, _ = fmt.Fprintf(w, `apiVersion: v1
+entries:
+  mychart:
+  - apiVersion: v2
+    name: mychart
+    version: 0.1.0
+    digest: sha256:%s
+    urls:
+    - %s/mychart-0.1.0.tgz
+generated: "2024-01-01T00:00:00Z"
+`, hex.EncodeToString(digest[:]), server.URL)
+	})
+
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestKustomizeHelmChartsInflation(t *testing.T) {
+	appPath, destroyDataDir := testDataDir(t, "./testdata/"+kustomization1)
+	defer destroyDataDir()
+
+	server := newFakeHelmChartServer(t)
+	defer server.Close()
+
+	// --enable-helm/--helm-command are gated by BuildOptionsPolicy; allow them for this test only.
+	SetBuildOptionsPolicy(BuildOptionsPolicy{AllowEnableHelm: true, AllowedHelmCommands: []string{CurrentHelmBinaryPath()}})
+	defer SetBuildOptionsPolicy(DefaultBuildOptionsPolicy())
+
+	kustomize := NewKustomizeApp(appPath, git.NopCreds{}, "", "")
+	kustomizeSource := v1alpha1.ApplicationSourceKustomize{
+		HelmCharts: []v1alpha1.KustomizeHelmChart{
+			{
+				Name:         "mychart",
+				Repo:         server.URL,
+				Version:      "0.1.0",
+				ReleaseName:  "my-release",
+				ValuesInline: "architecture: standalone",
+			},
+		},
+	}
+
+	objs, _, err := kustomize.Build(&kustomizeSource, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, objs)
+}
+
+func TestMergeHelmValues(t *testing.T) {
+	appPath, destroyDataDir := testDataDir(t, "./testdata/"+kustomization1)
+	defer destroyDataDir()
+
+	err := ioutil.WriteFile(filepath.Join(appPath, "base-values.yaml"), []byte("architecture: replication\nauth:\n  enabled: true\n"), 0644)
+	assert.NoError(t, err)
+
+	chart := v1alpha1.KustomizeHelmChart{
+		Name:         "redis",
+		ValuesFile:   "base-values.yaml",
+		ValuesInline: "architecture: standalone",
+	}
+	relPath, err := mergeHelmValues(appPath, chart)
+	assert.NoError(t, err)
+	assert.Equal(t, ".argocd-helm-values-redis.yaml", relPath)
+
+	merged, err := ioutil.ReadFile(filepath.Join(appPath, relPath))
+	assert.NoError(t, err)
+	assert.Contains(t, string(merged), "architecture: standalone")
+	assert.Contains(t, string(merged), "enabled: true")
+}
+
+func TestMergeHelmValuesRejectsValuesFileEscape(t *testing.T) {
+	appPath, destroyDataDir := testDataDir(t, "./testdata/"+kustomization1)
+	defer destroyDataDir()
+
+	chart := v1alpha1.KustomizeHelmChart{Name: "redis", ValuesFile: "../../../../etc/passwd"}
+	_, err := mergeHelmValues(appPath, chart)
+	assert.Error(t, err)
+}
+
+func TestSanitizeChartNameForFile(t *testing.T) {
+	assert.Equal(t, "redis", sanitizeChartNameForFile("redis"))
+	assert.Equal(t, "x_.._.._.._.._tmp_evil", sanitizeChartNameForFile("x/../../../../tmp/evil"))
+	assert.NotContains(t, sanitizeChartNameForFile("x/../../../../tmp/evil"), "/")
+}
+
+func TestParseBinaryPathRegistry(t *testing.T) {
+	registry := ParseBinaryPathRegistry(map[string]string{
+		"kustomize.path.v3.10.0": "/opt/kustomize/v3.10.0/kustomize",
+		"kustomize.path.v4.5.7":  "/opt/kustomize/v4.5.7/kustomize",
+		"unrelated.setting":      "ignored",
+	})
+
+	path, ok := registry.Lookup("v4.5.7")
+	assert.True(t, ok)
+	assert.Equal(t, "/opt/kustomize/v4.5.7/kustomize", path)
+
+	_, ok = registry.Lookup("v5.0.0")
+	assert.False(t, ok)
+}
+
+func TestResolveBinaryFallsBackToDefault(t *testing.T) {
+	SetBinaryPathRegistry(ParseBinaryPathRegistry(map[string]string{
+		"kustomize.path.v4.5.7": "/opt/kustomize/v4.5.7/kustomize",
+	}))
+	defer SetBinaryPathRegistry(BinaryPathRegistry{})
+
+	pinned := &kustomize{path: "testdata/" + kustomization1}
+	pinned.resolveBinary(&v1alpha1.ApplicationSourceKustomize{Version: "v4.5.7"})
+	assert.Equal(t, "/opt/kustomize/v4.5.7/kustomize", pinned.binary())
+
+	unpinned := &kustomize{path: "testdata/" + kustomization1}
+	unpinned.resolveBinary(&v1alpha1.ApplicationSourceKustomize{Version: "v9.9.9"})
+	assert.Equal(t, "kustomize", unpinned.binary())
+}
+
+func TestResolveBinaryDoesNotLeakAcrossCalls(t *testing.T) {
+	SetBinaryPathRegistry(ParseBinaryPathRegistry(map[string]string{
+		"kustomize.path.v4.5.7": "/opt/kustomize/v4.5.7/kustomize",
+	}))
+	defer SetBinaryPathRegistry(BinaryPathRegistry{})
+
+	reused := &kustomize{path: "testdata/" + kustomization1}
+	reused.resolveBinary(&v1alpha1.ApplicationSourceKustomize{Version: "v4.5.7"})
+	assert.Equal(t, "/opt/kustomize/v4.5.7/kustomize", reused.binary())
+
+	reused.resolveBinary(&v1alpha1.ApplicationSourceKustomize{Version: ""})
+	assert.Equal(t, "kustomize", reused.binary())
+}
+
+func TestExpandSubstitutionsMissingRequiredSource(t *testing.T) {
+	source := &v1alpha1.ApplicationSourceKustomize{
+		SubstituteFrom: []v1alpha1.SubstituteReference{
+			{Name: "missing-config", Kind: "ConfigMap"},
+		},
+	}
+
+	err := ExpandSubstitutions(nil, source, map[string]map[string]string{})
+	assert.Error(t, err)
+}
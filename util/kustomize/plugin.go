@@ -0,0 +1,318 @@
+package kustomize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+)
+
+// krmFunctionAnnotation is the annotation key kustomize's containerized KRM function runtime reads
+// a function's `container` spec (image, network, mounts, ...) from.
+const krmFunctionAnnotation = "config.kubernetes.io/function"
+
+// resolvePluginMounts validates and resolves the Src of each mount in cfg against appPath,
+// rejecting anything that would escape the application working directory or the repo-manifest-
+// server's home directory. A leading "~" in Src is expanded to serverHome; relative Src values
+// are resolved against appPath; absolute Src values are accepted only if they already fall under
+// one of those two roots.
+func resolvePluginMounts(appPath, serverHome string, cfg *v1alpha1.KustomizePluginConfig) ([]v1alpha1.StorageMount, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	resolved := make([]v1alpha1.StorageMount, 0, len(cfg.Mounts))
+	for _, mount := range cfg.Mounts {
+		src, err := resolveMountSrc(appPath, serverHome, mount.Src)
+		if err != nil {
+			return nil, err
+		}
+		mount.Src = src
+		resolved = append(resolved, mount)
+	}
+	return resolved, nil
+}
+
+func resolveMountSrc(appPath, serverHome, src string) (string, error) {
+	expanded := src
+	switch {
+	case src == "~":
+		expanded = serverHome
+	case strings.HasPrefix(src, "~/"):
+		expanded = filepath.Join(serverHome, strings.TrimPrefix(src, "~/"))
+	case !filepath.IsAbs(src):
+		expanded = filepath.Join(appPath, src)
+	}
+
+	cleaned := filepath.Clean(expanded)
+	if !pathUnder(cleaned, appPath) && !pathUnder(cleaned, serverHome) {
+		return "", fmt.Errorf("mount src %q resolves outside the application working directory", src)
+	}
+	return cleaned, nil
+}
+
+// pathUnder reports whether path is root itself or a descendant of root.
+func pathUnder(path, root string) bool {
+	if root == "" {
+		return false
+	}
+	root = filepath.Clean(root)
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (!strings.HasPrefix(rel, "..") && !filepath.IsAbs(rel))
+}
+
+// enforcePluginImageAllowlist scans the application's kustomization tree for KRM function /
+// containerized plugin image references and rejects any that aren't present in cfg.AllowedImages.
+// Every generator/transformer/validator file referenced from a kustomization.yaml is read and
+// structurally parsed as YAML (not regexed) so that a trailing comment or a flow-style mapping
+// can't hide an image reference from the allowlist, recursing into components.
+func (k *kustomize) enforcePluginImageAllowlist(cfg *v1alpha1.KustomizePluginConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	return walkFunctionFiles(k.path, map[string]bool{}, func(path string, doc map[string]interface{}) error {
+		for _, image := range collectImages(doc) {
+			if !imageAllowed(image, cfg.AllowedImages) {
+				return fmt.Errorf("KRM function image %q is not permitted by pluginConfig.allowedImages", image)
+			}
+		}
+		return nil
+	})
+}
+
+// applyPluginSandbox overwrites the `network` and `mounts` fields of every KRM function's
+// `config.kubernetes.io/function` annotation in the application's kustomization tree with the
+// resolved, validated values -- this is the field kustomize's containerized function runtime
+// actually reads to decide what the function container can see, so it's the only place sandboxing
+// the mounts/network takes effect rather than just being computed and discarded.
+func (k *kustomize) applyPluginSandbox(mounts []v1alpha1.StorageMount, network bool) error {
+	return walkFunctionFiles(k.path, map[string]bool{}, func(path string, doc map[string]interface{}) error {
+		fnDoc, container, ok := functionContainer(doc)
+		if !ok {
+			return nil
+		}
+		container["network"] = network
+		if len(mounts) > 0 {
+			container["mounts"] = mountEntries(mounts)
+		} else {
+			delete(container, "mounts")
+		}
+		fnDoc["container"] = container
+		return writeFunctionAnnotation(path, doc, fnDoc)
+	})
+}
+
+// walkFunctionFiles finds the kustomization file in dir, parses it, and invokes visit with the
+// decoded YAML document of the kustomization file itself and of every file referenced under its
+// generators/transformers/validators keys,
+// then recurses into any referenced components. visited tracks absolute kustomization file paths
+// already walked so that components referencing each other (or a shared base) aren't walked twice.
+func walkFunctionFiles(dir string, visited map[string]bool, visit func(path string, doc map[string]interface{}) error) error {
+	kustomizationFile, err := (&kustomize{path: dir}).findKustomization()
+	if err != nil {
+		return err
+	}
+	absKustomizationFile, err := filepath.Abs(kustomizationFile)
+	if err != nil {
+		return err
+	}
+	if visited[absKustomizationFile] {
+		return nil
+	}
+	visited[absKustomizationFile] = true
+
+	raw, err := ioutil.ReadFile(kustomizationFile)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	if err := visit(kustomizationFile, doc); err != nil {
+		return err
+	}
+
+	for _, key := range []string{"generators", "transformers", "validators"} {
+		for _, ref := range stringEntries(doc[key]) {
+			refPath := filepath.Join(dir, ref)
+			info, err := os.Stat(refPath)
+			if err != nil || info.IsDir() {
+				// Not a file reference (could be an inline generator spec, or missing); skip it.
+				continue
+			}
+			raw, err := ioutil.ReadFile(refPath)
+			if err != nil {
+				return err
+			}
+			var refDoc map[string]interface{}
+			if err := yaml.Unmarshal(raw, &refDoc); err != nil {
+				return err
+			}
+			if err := visit(refPath, refDoc); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ref := range stringEntries(doc["components"]) {
+		compDir := filepath.Join(dir, ref)
+		if info, err := os.Stat(compDir); err == nil && info.IsDir() {
+			if err := walkFunctionFiles(compDir, visited, visit); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectImages structurally walks a decoded YAML document -- including the YAML-encoded string
+// under a krmFunctionAnnotation key -- and returns every "image" field value it finds. Doing this
+// on the parsed document instead of the raw text means an inline comment after the value or a
+// flow-style `container: {image: ...}` mapping can't slip past the allowlist.
+func collectImages(node interface{}) []string {
+	var images []string
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if key == "image" {
+				if s, ok := child.(string); ok {
+					images = append(images, s)
+					continue
+				}
+			}
+			if key == krmFunctionAnnotation {
+				if raw, ok := child.(string); ok {
+					var fnDoc map[string]interface{}
+					if err := yaml.Unmarshal([]byte(raw), &fnDoc); err == nil {
+						images = append(images, collectImages(fnDoc)...)
+					}
+					continue
+				}
+			}
+			images = append(images, collectImages(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			images = append(images, collectImages(child)...)
+		}
+	}
+	return images
+}
+
+// functionContainer returns the decoded `config.kubernetes.io/function` annotation document and
+// its `container` field for doc, if any, ready for in-place mutation by the caller.
+func functionContainer(doc map[string]interface{}) (fnDoc map[string]interface{}, container map[string]interface{}, ok bool) {
+	raw, ok := functionAnnotation(doc)
+	if !ok {
+		return nil, nil, false
+	}
+	if err := yaml.Unmarshal([]byte(raw), &fnDoc); err != nil {
+		return nil, nil, false
+	}
+	container, _ = fnDoc["container"].(map[string]interface{})
+	if container == nil {
+		container = map[string]interface{}{}
+	}
+	return fnDoc, container, true
+}
+
+func functionAnnotation(doc map[string]interface{}) (string, bool) {
+	metadata, _ := doc["metadata"].(map[string]interface{})
+	if metadata == nil {
+		return "", false
+	}
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if annotations == nil {
+		return "", false
+	}
+	raw, ok := annotations[krmFunctionAnnotation].(string)
+	return raw, ok
+}
+
+// writeFunctionAnnotation re-encodes fnDoc back into doc's krmFunctionAnnotation and writes doc to
+// path, the file walkFunctionFiles read it from.
+func writeFunctionAnnotation(path string, doc, fnDoc map[string]interface{}) error {
+	fnRaw, err := yaml.Marshal(fnDoc)
+	if err != nil {
+		return err
+	}
+	metadata, _ := doc["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+	}
+	annotations[krmFunctionAnnotation] = string(fnRaw)
+	metadata["annotations"] = annotations
+	doc["metadata"] = metadata
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// mountEntries renders mounts into the map form the krmFunctionAnnotation's container.mounts field
+// expects.
+func mountEntries(mounts []v1alpha1.StorageMount) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(mounts))
+	for _, m := range mounts {
+		entry := map[string]interface{}{
+			"type": m.Type,
+			"src":  m.Src,
+			"dst":  m.Dst,
+		}
+		if m.ReadOnly {
+			entry["readonly"] = true
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// stringEntries returns the string elements of a YAML sequence value (as decoded into
+// []interface{}), ignoring entries that aren't plain strings (e.g. inline generator specs).
+func stringEntries(value interface{}) []string {
+	items, _ := value.([]interface{})
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func imageAllowed(image string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == image {
+			return true
+		}
+		// An allowlist entry with no tag permits any tag of that image.
+		if !strings.Contains(a, ":") && strings.HasPrefix(image, a+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// repoManifestServerHome returns the home directory mounts may be resolved relative to when
+// prefixed with "~".
+func repoManifestServerHome() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return os.Getenv("HOME")
+}
@@ -0,0 +1,226 @@
+package kustomize
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
+)
+
+// expansionPattern matches `${var}`, `${var:=default}`, `${var:offset:length}` and `${var/from/to}`.
+var expansionPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// ExpandSubstitutions performs the post-build substitution phase: it resolves
+// source.SubstituteFrom (using the already-fetched ConfigMap/Secret data in fromValues, keyed by
+// "<Kind>/<Name>") followed by source.Substitute, then shell-style expands every scalar string
+// value in objs against the resulting variable set. It mutates objs in place.
+func ExpandSubstitutions(objs []*unstructured.Unstructured, source *v1alpha1.ApplicationSourceKustomize, fromValues map[string]map[string]string) error {
+	if source == nil || (len(source.Substitute) == 0 && len(source.SubstituteFrom) == 0) {
+		return nil
+	}
+
+	vars, err := resolveSubstitutionVars(source, fromValues)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		expanded, err := expandNode(obj.Object, vars)
+		if err != nil {
+			return fmt.Errorf("failed to expand substitutions in %s %q: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		obj.Object = expanded.(map[string]interface{})
+	}
+	return nil
+}
+
+func resolveSubstitutionVars(source *v1alpha1.ApplicationSourceKustomize, fromValues map[string]map[string]string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, ref := range source.SubstituteFrom {
+		key := ref.Kind + "/" + ref.Name
+		data, ok := fromValues[key]
+		if !ok {
+			if ref.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("substituteFrom source %s not found", key)
+		}
+		for k, v := range data {
+			vars[k] = v
+		}
+	}
+	// Substitute is applied last so that inline literals override SubstituteFrom values.
+	for k, v := range source.Substitute {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// expandNode walks a decoded manifest (nested map[string]interface{}/[]interface{}/scalars, as
+// produced by unstructured.Unstructured) and expands every string leaf in place.
+func expandNode(node interface{}, vars map[string]string) (interface{}, error) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			expanded, err := expandNode(child, vars)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = expanded
+		}
+		return v, nil
+	case []interface{}:
+		for i, child := range v {
+			expanded, err := expandNode(child, vars)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+		return v, nil
+	case string:
+		return expandValue(v, vars)
+	default:
+		return v, nil
+	}
+}
+
+func expandValue(s string, vars map[string]string) (string, error) {
+	var firstErr error
+	result := expansionPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if firstErr != nil {
+			return match
+		}
+		inner := match[2 : len(match)-1]
+		val, err := expandToken(inner, vars)
+		if err != nil {
+			firstErr = err
+			return match
+		}
+		return val
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return result, nil
+}
+
+// expandToken evaluates the contents of a single `${...}` expression. The four forms (`${var}`,
+// `${var:=default}`, `${var:offset:length}`, `${var/from/to}`) are told apart by whichever operator
+// actually occurs first in inner, not by checking them in a fixed order: a default or replacement
+// value is free to contain a "/" (e.g. `${region:=us/east-1}`), and checking "/" unconditionally
+// before ":=" would misparse that as a replace expression.
+func expandToken(inner string, vars map[string]string) (string, error) {
+	slashIdx := strings.Index(inner, "/")
+	assignIdx := strings.Index(inner, ":=")
+	substringIdx := indexOfSubstringOp(inner)
+
+	op, idx := "", -1
+	for _, candidate := range []struct {
+		kind string
+		idx  int
+	}{{"replace", slashIdx}, {"default", assignIdx}, {"substring", substringIdx}} {
+		if candidate.idx == -1 {
+			continue
+		}
+		if idx == -1 || candidate.idx < idx {
+			op, idx = candidate.kind, candidate.idx
+		}
+	}
+
+	switch op {
+	case "replace":
+		name := inner[:idx]
+		rest := strings.SplitN(inner[idx+1:], "/", 2)
+		from := rest[0]
+		to := ""
+		if len(rest) > 1 {
+			to = rest[1]
+		}
+		val, err := requireVar(name, vars)
+		if err != nil {
+			return "", err
+		}
+		return strings.Replace(val, from, to, 1), nil
+	case "default":
+		name := inner[:idx]
+		def := inner[idx+2:]
+		if val, ok := vars[name]; ok && val != "" {
+			return val, nil
+		}
+		return def, nil
+	case "substring":
+		name := inner[:idx]
+		bits := strings.SplitN(inner[idx+1:], ":", 2)
+		offset, _ := strconv.Atoi(bits[0])
+		length, _ := strconv.Atoi(bits[1])
+		val, err := requireVar(name, vars)
+		if err != nil {
+			return "", err
+		}
+		return substring(val, offset, length), nil
+	}
+
+	// ${var}
+	return requireVar(inner, vars)
+}
+
+// indexOfSubstringOp returns the index of the ":" that begins a valid "name:offset:length"
+// construct, skipping over any ":" that instead starts a ":=" default operator. It returns -1 if
+// inner contains no such valid substring operator.
+func indexOfSubstringOp(inner string) int {
+	start := 0
+	for {
+		rel := strings.Index(inner[start:], ":")
+		if rel == -1 {
+			return -1
+		}
+		idx := start + rel
+		if idx+1 < len(inner) && inner[idx+1] == '=' {
+			start = idx + 2
+			continue
+		}
+		bits := strings.SplitN(inner[idx+1:], ":", 2)
+		if len(bits) == 2 {
+			if _, offErr := strconv.Atoi(bits[0]); offErr == nil {
+				if _, lenErr := strconv.Atoi(bits[1]); lenErr == nil {
+					return idx
+				}
+			}
+		}
+		return -1
+	}
+}
+
+func requireVar(name string, vars map[string]string) (string, error) {
+	val, ok := vars[name]
+	if !ok {
+		return "", fmt.Errorf("required substitution variable %q is not set", name)
+	}
+	return val, nil
+}
+
+func substring(s string, offset, length int) string {
+	runes := []rune(s)
+	if offset < 0 {
+		offset = len(runes) + offset
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(runes) {
+		offset = len(runes)
+	}
+	end := offset + length
+	if end > len(runes) {
+		end = len(runes)
+	}
+	if end < offset {
+		end = offset
+	}
+	return string(runes[offset:end])
+}
@@ -0,0 +1,57 @@
+package kustomize
+
+import (
+	"strings"
+	"sync"
+)
+
+// binaryPathConfigPrefix is the argocd-cm ConfigMap key prefix under which per-version kustomize
+// binary paths are configured, e.g. `kustomize.path.v4.5.7: /opt/kustomize/v4.5.7/kustomize`.
+const binaryPathConfigPrefix = "kustomize.path."
+
+// BinaryPathRegistry maps a kustomize version string (e.g. "v4.5.7") to the path of the
+// executable that implements it.
+type BinaryPathRegistry map[string]string
+
+// Lookup returns the configured binary path for version, if any.
+func (r BinaryPathRegistry) Lookup(version string) (string, bool) {
+	path, ok := r[version]
+	return path, ok
+}
+
+// ParseBinaryPathRegistry extracts a BinaryPathRegistry from argocd-cm ConfigMap data, reading
+// every `kustomize.path.<version>` key.
+func ParseBinaryPathRegistry(cmData map[string]string) BinaryPathRegistry {
+	registry := BinaryPathRegistry{}
+	for key, path := range cmData {
+		if !strings.HasPrefix(key, binaryPathConfigPrefix) {
+			continue
+		}
+		version := strings.TrimPrefix(key, binaryPathConfigPrefix)
+		if version == "" || path == "" {
+			continue
+		}
+		registry[version] = path
+	}
+	return registry
+}
+
+var (
+	globalBinaryRegistryMu sync.RWMutex
+	globalBinaryRegistry   = BinaryPathRegistry{}
+)
+
+// SetBinaryPathRegistry installs the process-wide registry of per-version kustomize binaries,
+// refreshed by the repo server whenever the argocd-cm ConfigMap changes.
+func SetBinaryPathRegistry(registry BinaryPathRegistry) {
+	globalBinaryRegistryMu.Lock()
+	defer globalBinaryRegistryMu.Unlock()
+	globalBinaryRegistry = registry
+}
+
+// CurrentBinaryPathRegistry returns the process-wide registry installed by SetBinaryPathRegistry.
+func CurrentBinaryPathRegistry() BinaryPathRegistry {
+	globalBinaryRegistryMu.RLock()
+	defer globalBinaryRegistryMu.RUnlock()
+	return globalBinaryRegistry
+}